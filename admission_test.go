@@ -0,0 +1,134 @@
+package wsutil
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestOriginMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "sub.example.com", false},
+		{"*.example.com", "sub.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "evilexample.com", false},
+		{"*.example.com", "notexample.com", false},
+	}
+	for _, tt := range tests {
+		if got := originMatches(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("originMatches(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestOriginCheckerAdmit(t *testing.T) {
+	c := OriginChecker{AllowedOrigins: []string{"example.com", "*.trusted.com"}}
+
+	tests := []struct {
+		name    string
+		origin  string
+		wantErr bool
+	}{
+		{"missing origin", "", true},
+		{"invalid origin", "://not a url", true},
+		{"exact match", "https://example.com", false},
+		{"wildcard match", "https://app.trusted.com", false},
+		{"wildcard does not match apex", "https://trusted.com", true},
+		{"not allowed", "https://evil.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{Header: http.Header{}}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			err := c.Admit(r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Admit(%q) error = %v, wantErr %v", tt.origin, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %v", s, err)
+	}
+	return n
+}
+
+func TestIPFilterAdmit(t *testing.T) {
+	allow := mustCIDR(t, "10.0.0.0/8")
+	deny := mustCIDR(t, "10.0.1.0/24")
+	allowPublic := mustCIDR(t, "198.51.100.0/24")
+
+	tests := []struct {
+		name       string
+		filter     IPFilter
+		remoteAddr string
+		xff        string
+		wantErr    bool
+	}{
+		{
+			name:       "allowed by cidr",
+			filter:     IPFilter{Allow: []*net.IPNet{allow}},
+			remoteAddr: "10.0.2.5:1234",
+			wantErr:    false,
+		},
+		{
+			name:       "not in allow list",
+			filter:     IPFilter{Allow: []*net.IPNet{allow}},
+			remoteAddr: "192.168.1.5:1234",
+			wantErr:    true,
+		},
+		{
+			name:       "deny takes precedence over allow",
+			filter:     IPFilter{Allow: []*net.IPNet{allow}, Deny: []*net.IPNet{deny}},
+			remoteAddr: "10.0.1.7:1234",
+			wantErr:    true,
+		},
+		{
+			name:       "empty allow list permits anything not denied",
+			filter:     IPFilter{Deny: []*net.IPNet{deny}},
+			remoteAddr: "8.8.8.8:1234",
+			wantErr:    false,
+		},
+		{
+			// 198.51.100.5 is the left-most non-private entry and is in
+			// the allow list; 203.0.113.10 (also public) is not, so
+			// picking the wrong entry would flip the expected result.
+			name:       "trusts left-most non-private X-Forwarded-For entry",
+			filter:     IPFilter{Allow: []*net.IPNet{allowPublic}, TrustXForwardedFor: true},
+			remoteAddr: "203.0.113.1:1234",
+			xff:        "198.51.100.5, 203.0.113.10",
+			wantErr:    false,
+		},
+		{
+			name:       "ignores X-Forwarded-For when not trusted",
+			filter:     IPFilter{Allow: []*net.IPNet{allowPublic}, TrustXForwardedFor: false},
+			remoteAddr: "203.0.113.1:1234",
+			xff:        "198.51.100.5, 203.0.113.10",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			err := tt.filter.Admit(r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Admit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
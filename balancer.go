@@ -0,0 +1,283 @@
+package wsutil
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackendPicker selects the backend a given request should be proxied to.
+// Implementations must be safe for concurrent use.
+type BackendPicker interface {
+	Pick(*http.Request) (*url.URL, error)
+}
+
+// ErrNoBackends is returned by a BackendPicker when no healthy backend is
+// available to serve a request.
+var ErrNoBackends = errors.New("wsutil: no healthy backends available")
+
+// backend tracks a single proxy target and whether it is currently
+// considered healthy by StartHealthCheck.
+type backend struct {
+	url     *url.URL
+	mu      sync.RWMutex
+	healthy bool
+}
+
+func (b *backend) setHealthy(healthy bool) {
+	b.mu.Lock()
+	b.healthy = healthy
+	b.mu.Unlock()
+}
+
+func (b *backend) isHealthy() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.healthy
+}
+
+// backendSet is the healthy-backend bookkeeping shared by the built-in
+// BackendPicker implementations below.
+type backendSet struct {
+	backends []*backend
+}
+
+func newBackendSet(targets []*url.URL) *backendSet {
+	backends := make([]*backend, len(targets))
+	for i, t := range targets {
+		backends[i] = &backend{url: t, healthy: true}
+	}
+	return &backendSet{backends: backends}
+}
+
+func (s *backendSet) healthy() []*backend {
+	healthy := make([]*backend, 0, len(s.backends))
+	for _, b := range s.backends {
+		if b.isHealthy() {
+			healthy = append(healthy, b)
+		}
+	}
+	return healthy
+}
+
+// roundRobinPicker is the BackendPicker returned by NewRoundRobinPicker.
+type roundRobinPicker struct {
+	set  *backendSet
+	next uint64
+}
+
+// NewRoundRobinPicker returns a BackendPicker that cycles through targets in
+// order, skipping any backend that StartHealthCheck has marked unhealthy.
+func NewRoundRobinPicker(targets []*url.URL) BackendPicker {
+	return &roundRobinPicker{set: newBackendSet(targets)}
+}
+
+func (p *roundRobinPicker) Pick(*http.Request) (*url.URL, error) {
+	healthy := p.set.healthy()
+	if len(healthy) == 0 {
+		return nil, ErrNoBackends
+	}
+	n := atomic.AddUint64(&p.next, 1)
+	return healthy[n%uint64(len(healthy))].url, nil
+}
+
+func (p *roundRobinPicker) backends() []*backend { return p.set.backends }
+
+// randomPicker is the BackendPicker returned by NewRandomPicker.
+type randomPicker struct {
+	set *backendSet
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewRandomPicker returns a BackendPicker that chooses uniformly at random
+// among the targets, skipping any backend that StartHealthCheck has marked
+// unhealthy.
+func NewRandomPicker(targets []*url.URL) BackendPicker {
+	return &randomPicker{set: newBackendSet(targets), rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (p *randomPicker) Pick(*http.Request) (*url.URL, error) {
+	healthy := p.set.healthy()
+	if len(healthy) == 0 {
+		return nil, ErrNoBackends
+	}
+	p.mu.Lock()
+	i := p.rnd.Intn(len(healthy))
+	p.mu.Unlock()
+	return healthy[i].url, nil
+}
+
+func (p *randomPicker) backends() []*backend { return p.set.backends }
+
+// hashPicker is the BackendPicker returned by NewConsistentHashPicker.
+type hashPicker struct {
+	set    *backendSet
+	header string
+}
+
+// NewConsistentHashPicker returns a BackendPicker that routes requests
+// bearing the same value of header to the same backend, using rendezvous
+// (highest random weight) hashing: each backend is scored against the
+// header value, and the backend with the highest score wins. Unlike a
+// plain hash-modulo-count scheme, adding or removing a backend (e.g. a
+// health check taking one out of rotation) only remaps the keys that had
+// picked that backend, leaving every other key's destination unchanged.
+// It is useful for routing a given client's WebSocket connections to the
+// same backend consistently, e.g. by hashing an X-User-Id or
+// X-Forwarded-For header.
+func NewConsistentHashPicker(targets []*url.URL, header string) BackendPicker {
+	return &hashPicker{set: newBackendSet(targets), header: header}
+}
+
+func (p *hashPicker) Pick(r *http.Request) (*url.URL, error) {
+	healthy := p.set.healthy()
+	if len(healthy) == 0 {
+		return nil, ErrNoBackends
+	}
+	key := r.Header.Get(p.header)
+	best := healthy[0]
+	bestScore := rendezvousScore(best.url.String(), key)
+	for _, b := range healthy[1:] {
+		if score := rendezvousScore(b.url.String(), key); score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best.url, nil
+}
+
+// rendezvousScore computes backendID's weight for key, for use by
+// hashPicker's rendezvous hashing: the backend with the highest score for
+// a given key is the one selected.
+func rendezvousScore(backendID, key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(backendID))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (p *hashPicker) backends() []*backend { return p.set.backends }
+
+// healthChecker is implemented by the BackendPicker types returned by
+// NewRoundRobinPicker, NewRandomPicker, and NewConsistentHashPicker, so that
+// StartHealthCheck can probe their backends without depending on a specific
+// picker implementation.
+type healthChecker interface {
+	backends() []*backend
+}
+
+// HealthCheckConfig configures the periodic backend probing started by
+// StartHealthCheck.
+type HealthCheckConfig struct {
+	// Path is the URL path probed with an HTTP GET on each backend.
+	// Defaults to "/".
+	Path string
+
+	// Interval is how often each backend is probed. Defaults to 10s.
+	Interval time.Duration
+
+	// Timeout bounds each probe request. Defaults to Interval, capped at
+	// 2s.
+	Timeout time.Duration
+}
+
+// StartHealthCheck periodically probes each backend known to picker with an
+// HTTP GET and takes it out of rotation when the probe fails or returns a
+// 5xx status, restoring it once probes succeed again. Probing stops when
+// the returned stop function is called. picker must have been created by
+// NewRoundRobinPicker, NewRandomPicker, or NewConsistentHashPicker; other
+// BackendPicker implementations are left untouched and stop is a no-op.
+func StartHealthCheck(picker BackendPicker, cfg HealthCheckConfig) (stop func()) {
+	hc, ok := picker.(healthChecker)
+	if !ok {
+		return func() {}
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = cfg.Interval
+		if cfg.Timeout > 2*time.Second {
+			cfg.Timeout = 2 * time.Second
+		}
+	}
+	client := &http.Client{Timeout: cfg.Timeout}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, b := range hc.backends() {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			ticker := time.NewTicker(cfg.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					probeBackend(client, b, cfg.Path)
+				}
+			}
+		}(b)
+	}
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func probeBackend(client *http.Client, b *backend, path string) {
+	u := *b.url
+	u.Path = singleJoiningSlash(u.Path, path)
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		b.setHealthy(false)
+		return
+	}
+	resp.Body.Close()
+	b.setHealthy(resp.StatusCode < 500)
+}
+
+// NewMultipleHostReverseProxy returns a new websocket ReverseProxy that
+// forwards each request to a backend chosen by picker from the targets
+// picker was created with; the targets argument itself is not used. Use
+// NewRoundRobinPicker, NewRandomPicker, or NewConsistentHashPicker for the
+// common load-balancing strategies, optionally combined with
+// StartHealthCheck, or supply a custom BackendPicker.
+func NewMultipleHostReverseProxy(targets []*url.URL, picker BackendPicker) *ReverseProxy {
+	rewrite := func(pr *ProxyRequest) {
+		target, err := picker.Pick(pr.In)
+		if err != nil {
+			// Rewrite has no return value of its own, so stash the error
+			// on the request context; ServeHTTP reports it through
+			// ErrorHandler instead of dialing pr.Out.URL as-is.
+			pr.Out = withPickError(pr.Out, err)
+			return
+		}
+		targetQuery := target.RawQuery
+		pr.Out.URL.Scheme = target.Scheme
+		pr.Out.URL.Host = target.Host
+		pr.Out.URL.Path = singleJoiningSlash(target.Path, pr.Out.URL.Path)
+		if targetQuery == "" || pr.Out.URL.RawQuery == "" {
+			pr.Out.URL.RawQuery = targetQuery + pr.Out.URL.RawQuery
+		} else {
+			pr.Out.URL.RawQuery = targetQuery + "&" + pr.Out.URL.RawQuery
+		}
+	}
+	return &ReverseProxy{Rewrite: rewrite}
+}
@@ -0,0 +1,45 @@
+package wsutil
+
+import "sync"
+
+// defaultCopyBufferSize is the size of buffers handed out by the default
+// BufferPool, matching the size io.Copy itself allocates when no buffer is
+// supplied.
+const defaultCopyBufferSize = 32 * 1024
+
+// BufferPool is a pool of byte slices that can be reused by the copy loop
+// in ServeHTTP, avoiding a fresh allocation per connection per direction.
+// Implementations must be safe for concurrent use.
+type BufferPool interface {
+	// Get returns a buffer of any non-zero length.
+	Get() []byte
+
+	// Put returns a buffer acquired from Get back to the pool.
+	Put([]byte)
+}
+
+// defaultBufferPool is the BufferPool used by ServeHTTP when
+// ReverseProxy.BufferPool is nil.
+var defaultBufferPool BufferPool = newSyncPoolBufferPool()
+
+type syncPoolBufferPool struct {
+	pool sync.Pool
+}
+
+func newSyncPoolBufferPool() *syncPoolBufferPool {
+	return &syncPoolBufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				return make([]byte, defaultCopyBufferSize)
+			},
+		},
+	}
+}
+
+func (p *syncPoolBufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *syncPoolBufferPool) Put(b []byte) {
+	p.pool.Put(b)
+}
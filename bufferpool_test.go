@@ -0,0 +1,19 @@
+package wsutil
+
+import "testing"
+
+func TestSyncPoolBufferPool(t *testing.T) {
+	pool := newSyncPoolBufferPool()
+
+	buf := pool.Get()
+	if len(buf) != defaultCopyBufferSize {
+		t.Fatalf("Get() returned a buffer of length %d, want %d", len(buf), defaultCopyBufferSize)
+	}
+	buf[0] = 0x42
+	pool.Put(buf)
+
+	again := pool.Get()
+	if len(again) != defaultCopyBufferSize {
+		t.Fatalf("Get() after Put returned a buffer of length %d, want %d", len(again), defaultCopyBufferSize)
+	}
+}
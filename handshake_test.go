@@ -0,0 +1,37 @@
+package wsutil
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestModifyHandshakeResponseRejectionUsesErrorHandler(t *testing.T) {
+	backend := startEchoBackend(t)
+	proxy := NewSingleHostReverseProxy(backend)
+
+	rejectErr := errors.New("subprotocol not supported")
+	proxy.ModifyHandshakeResponse = func(resp *http.Response) error {
+		return rejectErr
+	}
+	var gotErr error
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		gotErr = err
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	rw := httptest.NewRecorder()
+
+	proxy.ServeHTTP(rw, r)
+
+	if !errors.Is(gotErr, rejectErr) {
+		t.Errorf("ErrorHandler error = %v, want %v", gotErr, rejectErr)
+	}
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusBadGateway)
+	}
+}
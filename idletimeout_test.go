@@ -0,0 +1,56 @@
+package wsutil
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeConn is a minimal net.Conn whose embedded net.Conn is nil; only the
+// methods idleTimeoutConn actually calls are implemented, so accidentally
+// exercising anything else panics loudly instead of silently doing nothing.
+type fakeConn struct {
+	net.Conn
+	readFunc  func([]byte) (int, error)
+	deadlines []time.Time
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	if c.readFunc != nil {
+		return c.readFunc(b)
+	}
+	return len(b), nil
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func TestNewIdleTimeoutConnZeroDisables(t *testing.T) {
+	fc := &fakeConn{}
+	if got := newIdleTimeoutConn(fc, 0); got != net.Conn(fc) {
+		t.Errorf("newIdleTimeoutConn with zero timeout returned a wrapped conn, want the original conn unwrapped")
+	}
+}
+
+func TestIdleTimeoutConnRefreshesDeadlineOnEachRead(t *testing.T) {
+	fc := &fakeConn{}
+	const timeout = 5 * time.Second
+	c := newIdleTimeoutConn(fc, timeout)
+
+	buf := make([]byte, 4)
+	for i := 0; i < 2; i++ {
+		before := time.Now()
+		if _, err := c.Read(buf); err != nil {
+			t.Fatalf("Read #%d: %v", i+1, err)
+		}
+		if len(fc.deadlines) != i+1 {
+			t.Fatalf("after Read #%d, got %d SetReadDeadline calls, want %d", i+1, len(fc.deadlines), i+1)
+		}
+		got := fc.deadlines[i]
+		if got.Before(before.Add(timeout)) || got.After(time.Now().Add(timeout)) {
+			t.Errorf("Read #%d set deadline %v, want roughly %v", i+1, got, before.Add(timeout))
+		}
+	}
+}
@@ -1,12 +1,16 @@
 package wsutil
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 // ReverseProxy is a WebSocket reverse proxy. It will not work with a regular
@@ -24,6 +28,69 @@ type ReverseProxy struct {
 	// If Dial is nil, net.Dial is used.
 	Dial func(network, addr string) (net.Conn, error)
 
+	// DialTLS specifies the dial function for dialing the proxied server
+	// when the outgoing request scheme is "wss" or "https". If DialTLS is
+	// nil, tls.Dial is used with TLSClientConfig.
+	DialTLS func(network, addr string) (net.Conn, error)
+
+	// TLSClientConfig specifies the TLS configuration to use when dialing
+	// a wss:// backend with the default DialTLS. If nil, the default
+	// configuration is used.
+	TLSClientConfig *tls.Config
+
+	// Rewrite, if non-nil, is called with the request to be sent to the
+	// backend, letting the caller inspect or modify it via ProxyRequest.
+	// Rewrite takes precedence over Director when both are set, and unlike
+	// Director, which sees only the outgoing request, it is given both the
+	// inbound request (ProxyRequest.In) and the outgoing one
+	// (ProxyRequest.Out).
+	// Callers that want the X-Forwarded-* headers set should call
+	// ProxyRequest.SetXForwarded from within Rewrite; this mirrors the
+	// Rewrite/Director split added to net/http/httputil.ReverseProxy.
+	Rewrite func(*ProxyRequest)
+
+	// ModifyHandshakeResponse, if non-nil, is called with the backend's
+	// handshake response before it is written to the hijacked client
+	// connection. It may mutate resp's headers (e.g. to adjust the
+	// negotiated subprotocol or cookies) or return an error to reject the
+	// handshake instead of forwarding it, for example when resp.StatusCode
+	// is not 101.
+	ModifyHandshakeResponse func(resp *http.Response) error
+
+	// ErrorHandler, if non-nil, is called instead of the default reply
+	// (a generic 500, or a 403 for an Admit rejection) for Admit
+	// rejections and for errors selecting or dialing the backend,
+	// completing its handshake, or running ModifyHandshakeResponse. The
+	// error is logged either way. It is never called once the client
+	// connection has been hijacked.
+	ErrorHandler func(http.ResponseWriter, *http.Request, error)
+
+	// BufferPool, if non-nil, supplies the buffers used to copy data
+	// between the client and backend connections, in place of the 32KiB
+	// buffers io.Copy would otherwise allocate per direction per
+	// connection. If nil, a shared sync.Pool-backed pool is used.
+	BufferPool BufferPool
+
+	// HandshakeTimeout bounds the time spent dialing the backend and
+	// reading its handshake response. Zero means no timeout.
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout bounds how long either the client or backend connection
+	// may go without sending data once the WebSocket handshake has
+	// completed; it is refreshed on every read. A connection that exceeds
+	// it is closed, so a proxied connection with no more traffic on
+	// either side doesn't leak its two copy goroutines forever. Zero
+	// means no timeout.
+	IdleTimeout time.Duration
+
+	// Admit, if non-nil, is called with the original inbound request
+	// before the backend is dialed. A non-nil error rejects the request
+	// instead of proxying it, with a 403 response, or through ErrorHandler
+	// if that is set; see IPFilter and
+	// OriginChecker for common implementations, usable as e.g.
+	// `proxy.Admit = someIPFilter.Admit`.
+	Admit func(*http.Request) error
+
 	// ErrorLog specifies an optional logger for errors
 	// that occur when attempting to proxy the request.
 	// If nil, logging goes to os.Stderr via the log package's
@@ -31,6 +98,73 @@ type ReverseProxy struct {
 	ErrorLog *log.Logger
 }
 
+// ProxyRequest contains the request to be sent to the backend, to be
+// inspected or modified by a ReverseProxy's Rewrite function. See
+// net/http/httputil.ProxyRequest, which this mirrors.
+type ProxyRequest struct {
+	// In is the request received by the proxy's ServeHTTP method,
+	// unmodified. It should not be mutated.
+	In *http.Request
+
+	// Out is the request to be sent to the backend, which Rewrite may
+	// modify. It starts out as a shallow copy of In with its own Header
+	// map and URL, as built by ServeHTTP.
+	Out *http.Request
+}
+
+// SetXForwarded sets the X-Forwarded-For, X-Forwarded-Host, and
+// X-Forwarded-Proto headers of r.Out, appending the client address to any
+// existing X-Forwarded-For value rather than replacing it. It mirrors
+// net/http/httputil.ProxyRequest.SetXForwarded, substituting "ws"/"wss" for
+// the forwarded protocol.
+func (r *ProxyRequest) SetXForwarded() {
+	if clientIP, _, err := net.SplitHostPort(r.In.RemoteAddr); err == nil {
+		prior := r.Out.Header.Get("X-Forwarded-For")
+		if prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		r.Out.Header.Set("X-Forwarded-For", clientIP)
+	}
+	r.Out.Header.Set("X-Forwarded-Host", r.In.Host)
+	proto := "ws"
+	if r.In.TLS != nil {
+		proto = "wss"
+	}
+	r.Out.Header.Set("X-Forwarded-Proto", proto)
+}
+
+// hopHeaders lists the headers stripped from the outgoing request by
+// ServeHTTP, following the hop-by-hop headers in RFC 7230 §6.1.
+// Connection and Upgrade are deliberately left off this list: a WebSocket
+// handshake depends on "Connection: Upgrade" and "Upgrade: websocket"
+// reaching the backend unchanged.
+var hopHeaders = []string{
+	"Proxy-Connection",
+	"Keep-Alive",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, header := range hopHeaders {
+		h.Del(header)
+	}
+}
+
+// pickErrorContextKey is the context key a Rewrite function (such as the
+// one built by NewMultipleHostReverseProxy) can use to report a backend
+// selection failure back to ServeHTTP, since Rewrite has no return value of
+// its own. ServeHTTP checks for it right after running Rewrite/Director
+// and fails the request through ErrorHandler instead of dialing.
+type pickErrorContextKey struct{}
+
+// withPickError returns req with err attached so ServeHTTP reports it
+// through ErrorHandler instead of dialing outreq.URL as-is.
+func withPickError(req *http.Request, err error) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), pickErrorContextKey{}, err))
+}
+
 // stolen from net/http/httputil. singleJoiningSlash ensures that the route
 // '/a/' joined with '/b' becomes '/a/b'.
 func singleJoiningSlash(a, b string) string {
@@ -48,7 +182,9 @@ func singleJoiningSlash(a, b string) string {
 // NewSingleHostReverseProxy returns a new websocket ReverseProxy. The path
 // rewrites follow the same rules as the httputil.ReverseProxy. If the target
 // url has the path '/foo' and the incoming request '/bar', the request path
-// will be updated to '/foo/bar' before forwarding.
+// will be updated to '/foo/bar' before forwarding. The target's scheme is
+// preserved, so a target url of the form 'wss://backend/...' results in a
+// TLS connection to the backend.
 func NewSingleHostReverseProxy(target *url.URL) *ReverseProxy {
 	targetQuery := target.RawQuery
 	director := func(req *http.Request) {
@@ -70,28 +206,103 @@ func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if p.ErrorLog != nil {
 		logFunc = p.ErrorLog.Printf
 	}
+	if p.Admit != nil {
+		if err := p.Admit(r); err != nil {
+			logFunc("Request rejected by Admit: %v", err)
+			if p.ErrorHandler != nil {
+				p.ErrorHandler(w, r, err)
+			} else {
+				http.Error(w, err.Error(), http.StatusForbidden)
+			}
+			return
+		}
+	}
 	outreq := new(http.Request)
 	// shallow copying
 	*outreq = *r
-	p.Director(outreq)
+	outreq.Header = r.Header.Clone()
+	outURL := *r.URL
+	outreq.URL = &outURL
+	if p.Rewrite != nil {
+		pr := &ProxyRequest{In: r, Out: outreq}
+		p.Rewrite(pr)
+		outreq = pr.Out
+	} else if p.Director != nil {
+		p.Director(outreq)
+	}
+	if pickErr, ok := outreq.Context().Value(pickErrorContextKey{}).(error); ok {
+		logFunc("Error selecting backend for %s: %v", r.URL, pickErr)
+		p.handleError(w, r, pickErr)
+		return
+	}
+	removeHopHeaders(outreq.Header)
 	host := outreq.URL.Host
-	// if host does not specify a port, default to port 80
+	useTLS := outreq.URL.Scheme == "wss" || outreq.URL.Scheme == "https"
+	// if host does not specify a port, default to the scheme's well-known port
 	if !strings.Contains(host, ":") {
-		host = host + ":80"
+		if useTLS {
+			host = host + ":443"
+		} else {
+			host = host + ":80"
+		}
 	}
-	dial := p.Dial
-	if dial == nil {
-		dial = net.Dial
+	var d net.Conn
+	var err error
+	if useTLS {
+		dialTLS := p.DialTLS
+		if dialTLS == nil {
+			dialer := &net.Dialer{Timeout: p.HandshakeTimeout}
+			dialTLS = func(network, addr string) (net.Conn, error) {
+				return tls.DialWithDialer(dialer, network, addr, p.TLSClientConfig)
+			}
+		}
+		d, err = dialTLS("tcp", host)
+	} else {
+		dial := p.Dial
+		if dial == nil {
+			dial = (&net.Dialer{Timeout: p.HandshakeTimeout}).Dial
+		}
+		d, err = dial("tcp", host)
 	}
-	d, err := dial("tcp", host)
 	if err != nil {
-		http.Error(w, "Error forwarding request.", 500)
 		logFunc("Error dialing websocket backend %s: %v", outreq.URL, err)
+		p.handleError(w, r, err)
+		return
+	}
+	defer d.Close()
+
+	if p.HandshakeTimeout > 0 {
+		d.SetDeadline(time.Now().Add(p.HandshakeTimeout))
+	}
+
+	if err := outreq.Write(d); err != nil {
+		logFunc("Error writing request to backend %s: %v", outreq.URL, err)
+		p.handleError(w, r, err)
 		return
 	}
+	br := bufio.NewReader(d)
+	resp, err := http.ReadResponse(br, outreq)
+	if err != nil {
+		logFunc("Error reading handshake response from backend %s: %v", outreq.URL, err)
+		p.handleError(w, r, err)
+		return
+	}
+	if p.ModifyHandshakeResponse != nil {
+		if err := p.ModifyHandshakeResponse(resp); err != nil {
+			resp.Body.Close()
+			logFunc("Error from ModifyHandshakeResponse: %v", err)
+			p.handleError(w, r, err)
+			return
+		}
+	}
+	if p.HandshakeTimeout > 0 {
+		d.SetDeadline(time.Time{})
+	}
+
 	// All request generated by the http package implement this interface.
 	hj, ok := w.(http.Hijacker)
 	if !ok {
+		resp.Body.Close()
 		http.Error(w, "Not a hijacker?", 500)
 		return
 	}
@@ -99,25 +310,77 @@ func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// After, it bcomes this functions job to manage it. `nc` is of type *net.Conn.
 	nc, _, err := hj.Hijack()
 	if err != nil {
+		resp.Body.Close()
 		logFunc("Hijack error: %v", err)
 		return
 	}
 	defer nc.Close() // must close the underlying net connection after hijacking
-	defer d.Close()
 
-	err = outreq.Write(d) // write the modified incoming request to the dialed connection
-	if err != nil {
-		logFunc("Error copying request to target: %v", err)
+	if err := resp.Write(nc); err != nil {
+		logFunc("Error writing handshake response to client: %v", err)
 		return
 	}
+
+	ncIdle := newIdleTimeoutConn(nc, p.IdleTimeout)
+	dIdle := newIdleTimeoutConn(d, p.IdleTimeout)
+
+	bufferPool := p.BufferPool
+	if bufferPool == nil {
+		bufferPool = defaultBufferPool
+	}
 	errc := make(chan error, 2)
 	cp := func(dst io.Writer, src io.Reader) {
-		_, err := io.Copy(dst, src)
+		buf := bufferPool.Get()
+		_, err := io.CopyBuffer(dst, src, buf)
+		bufferPool.Put(buf)
 		errc <- err
 	}
-	go cp(d, nc)
-	go cp(nc, d)
+	// br may already hold bytes read past the handshake response (the start
+	// of the backend's first WebSocket frames). Only the bytes already
+	// buffered are drained from br itself; every subsequent read must go
+	// through dIdle so the idle timeout actually applies to this direction
+	// instead of being serviced forever by br's unwrapped underlying conn.
+	go cp(ncIdle, io.MultiReader(io.LimitReader(br, int64(br.Buffered())), dIdle))
+	go cp(dIdle, ncIdle)
+	// Wait for the first direction to finish or error, then close both
+	// sides so the second goroutine's blocked Read unblocks instead of
+	// leaking for the lifetime of the process.
 	<-errc
+	nc.Close()
+	d.Close()
+	<-errc
+}
+
+// idleTimeoutConn wraps a net.Conn so that every Read refreshes a
+// SetReadDeadline timeout, making a Read that waits longer than timeout
+// fail with a timeout error; closing the connection is left to the caller.
+// A zero timeout disables this behavior.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func newIdleTimeoutConn(c net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return c
+	}
+	return &idleTimeoutConn{Conn: c, timeout: timeout}
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+// handleError reports an error that occurred while dialing the backend or
+// completing its WebSocket handshake, before the client connection was
+// hijacked. It uses p.ErrorHandler if set, or a generic 500 otherwise.
+func (p *ReverseProxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if p.ErrorHandler != nil {
+		p.ErrorHandler(w, r, err)
+		return
+	}
+	http.Error(w, "Error forwarding request.", 500)
 }
 
 // IsWebSocketRequest returns a boolean indicating whether the request has the
@@ -0,0 +1,205 @@
+package wsutil
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startEchoBackend starts a raw TCP server that performs a minimal WebSocket
+// handshake (replying 101 Switching Protocols) and then echoes whatever
+// bytes it receives, so tests can drive a ReverseProxy end to end without a
+// real WebSocket library.
+func startEchoBackend(t *testing.T) *url.URL {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	// Accept connections for the lifetime of the test: callers may dial
+	// this backend more than once (e.g. one ReverseProxy per picker under
+	// test), so a single Accept would leave later dials hanging forever.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				req.Body.Close()
+				resp := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+				if _, err := conn.Write([]byte(resp)); err != nil {
+					return
+				}
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if n > 0 {
+						if _, werr := conn.Write(buf[:n]); werr != nil {
+							return
+						}
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return &url.URL{Scheme: "ws", Host: ln.Addr().String()}
+}
+
+// dialHandshake opens a raw connection to addr, performs the client side of
+// the WebSocket upgrade, and returns the parsed handshake response along
+// with the still-open connection for further reads/writes.
+func dialHandshake(t *testing.T, addr string) (*http.Response, net.Conn) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("write handshake request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("read handshake response: %v", err)
+	}
+	return resp, conn
+}
+
+func TestReverseProxyEndToEnd(t *testing.T) {
+	backend := startEchoBackend(t)
+
+	for _, tt := range []struct {
+		name   string
+		picker BackendPicker
+	}{
+		{"round-robin", NewRoundRobinPicker([]*url.URL{backend})},
+		{"random", NewRandomPicker([]*url.URL{backend})},
+		{"consistent-hash", NewConsistentHashPicker([]*url.URL{backend}, "X-User-Id")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := NewMultipleHostReverseProxy([]*url.URL{backend}, tt.picker)
+			proxy.IdleTimeout = time.Second
+			modified := false
+			proxy.ModifyHandshakeResponse = func(resp *http.Response) error {
+				modified = true
+				resp.Header.Set("X-Proxied-By", "wsutil")
+				return nil
+			}
+			ts := httptest.NewServer(proxy)
+			defer ts.Close()
+
+			addr := strings.TrimPrefix(ts.URL, "http://")
+			resp, conn := dialHandshake(t, addr)
+			defer conn.Close()
+
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+			if !modified {
+				t.Error("ModifyHandshakeResponse was not called")
+			}
+			if got := resp.Header.Get("X-Proxied-By"); got != "wsutil" {
+				t.Errorf("X-Proxied-By header = %q, want %q (ModifyHandshakeResponse change lost)", got, "wsutil")
+			}
+
+			const payload = "hello over the wire"
+			if _, err := conn.Write([]byte(payload)); err != nil {
+				t.Fatalf("write payload: %v", err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, len(payload))
+			if _, err := readFull(conn, buf); err != nil {
+				t.Fatalf("read echoed payload: %v", err)
+			}
+			if string(buf) != payload {
+				t.Errorf("echoed payload = %q, want %q", buf, payload)
+			}
+		})
+	}
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func TestReverseProxyErrorHandlerOnDialFailure(t *testing.T) {
+	// Nothing is listening on this address, so the dial is expected to fail.
+	unreachable := &url.URL{Scheme: "ws", Host: "127.0.0.1:1"}
+	proxy := NewSingleHostReverseProxy(unreachable)
+
+	var gotErr error
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		gotErr = err
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	rw := httptest.NewRecorder()
+
+	proxy.ServeHTTP(rw, r)
+
+	if gotErr == nil {
+		t.Fatal("ErrorHandler was not called")
+	}
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusBadGateway)
+	}
+}
+
+func TestReverseProxyNoHealthyBackendFailsFast(t *testing.T) {
+	picker := NewRoundRobinPicker(nil)
+	proxy := NewMultipleHostReverseProxy(nil, picker)
+
+	var gotErr error
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		gotErr = err
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	rw := httptest.NewRecorder()
+
+	proxy.ServeHTTP(rw, r)
+
+	if !errors.Is(gotErr, ErrNoBackends) {
+		t.Errorf("ErrorHandler error = %v, want %v", gotErr, ErrNoBackends)
+	}
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusServiceUnavailable)
+	}
+}